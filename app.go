@@ -7,7 +7,7 @@ import (
 	"syscall"
 	"time"
 
-	kjs "github.com/replicatedhq/kots-lint/kubernetes_json_schema"
+	"github.com/replicatedhq/kots-lint/pkg/cli"
 	"github.com/replicatedhq/kots-lint/pkg/daemon"
 	"github.com/replicatedhq/kots-lint/pkg/kots"
 	log "github.com/sirupsen/logrus"
@@ -20,12 +20,10 @@ func main() {
 		log.SetLevel(logLevel)
 	}
 
-	schemaDir, err := kjs.InitKubernetesJsonSchemaDir()
-	if err != nil {
-		log.Errorf("failed to init kubernetes json schema dir: %v", err)
-		os.Exit(1)
+	// lint a local release without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		os.Exit(cli.Lint(os.Args[2:], os.Stdout, os.Stderr))
 	}
-	defer os.RemoveAll(schemaDir)
 
 	if err := kots.InitOPALinting(); err != nil {
 		log.Errorf("failed to init opa linting: %v", err)
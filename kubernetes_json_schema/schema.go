@@ -4,68 +4,368 @@ import (
 	"embed"
 	"fmt"
 	"io/fs"
-	"os"
-	"path/filepath"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+	"sigs.k8s.io/yaml"
 )
 
+// KUBERNETES_LINT_VERSION is the Kubernetes version of the schemas that releases are validated against by default
 const KUBERNETES_LINT_VERSION = "1.33.3"
 
 //go:embed schema/**/*.json
 var kubernetesJsonSchemaFS embed.FS
 
-// the directory that holds the kubernetes json schema files
-var KubernetesJsonSchemaDir string
+// ErrSchemaNotFound is returned when there is no schema for the apiVersion and kind of a resource
+var ErrSchemaNotFound = errors.New("schema not found")
 
-func InitKubernetesJsonSchemaDir() (string, error) {
-	return initKubernetesJsonSchemaDir(kubernetesJsonSchemaFS)
+// kubernetesSchemaDirRegex matches the directories of the schemas of a Kubernetes version, e.g. v1.33.3-standalone-strict
+var kubernetesSchemaDirRegex = regexp.MustCompile(`^v(\d+)\.(\d+)\.(\d+)-standalone-strict$`)
+
+var kubernetesVersionRegex = regexp.MustCompile(`^v?(\d+)\.(\d+)`)
+
+var defaultValidator = NewValidator(kubernetesJsonSchemaFS, KUBERNETES_LINT_VERSION)
+
+// embeddedValidators are the validators of the embedded schemas by Kubernetes version
+var embeddedValidators = map[string]*Validator{KUBERNETES_LINT_VERSION: defaultValidator}
+var embeddedValidatorsMu sync.Mutex
+
+// registerFormatsOnce registers the OpenAPI formats of the Kubernetes schemas that gojsonschema does not know,
+// once, since the format checkers are global and cannot be changed while resources are validated
+var registerFormatsOnce sync.Once
+
+// Validator validates resources against the JSON schemas in a file system, by apiVersion and kind.
+// Schemas are read and compiled once, the first time a resource of their kind is validated, and cached with the kinds
+// that have no schema, so a Validator is meant to be shared by concurrent requests.
+type Validator struct {
+	schemaFS          fs.FS
+	kubernetesVersion string
+
+	indexOnce sync.Once
+	// index has the paths of the schemas in schemaFS by file name, e.g. deployment-apps-v1.json
+	index    map[string]string
+	indexErr error
+
+	mu      sync.Mutex
+	schemas map[string]*cachedSchema
+}
+
+type cachedSchema struct {
+	once   sync.Once
+	schema *gojsonschema.Schema
+	err    error
+}
+
+// NewValidator returns a Validator for the schemas in the subdirectories of the root directory of schemaFS,
+// which are named by kind, group and version like kubeval schemas, e.g. schema/v1.33.3-standalone-strict/deployment-apps-v1.json.
+// Of the directories of Kubernetes versions, only the one of kubernetesVersion is used.
+// Schemas with the same file name in later directories take precedence.
+func NewValidator(schemaFS fs.FS, kubernetesVersion string) *Validator {
+	registerFormatsOnce.Do(func() {
+		for _, format := range []string{"int64", "byte", "int32", "int-or-string"} {
+			gojsonschema.FormatCheckers.Add(format, anyFormat{})
+		}
+	})
+
+	return &Validator{
+		schemaFS:          schemaFS,
+		kubernetesVersion: kubernetesVersion,
+		schemas:           map[string]*cachedSchema{},
+	}
+}
+
+// DefaultValidator returns the Validator of the embedded Kubernetes, KOTS, Troubleshoot, Velero and Embedded Cluster schemas,
+// with the Kubernetes schemas of KUBERNETES_LINT_VERSION
+func DefaultValidator() *Validator {
+	return defaultValidator
+}
+
+// ValidatorForKubernetesVersion returns the Validator of the embedded schemas with the Kubernetes schemas of a version,
+// which is resolved with ResolveKubernetesVersion. Validators are created once per version.
+func ValidatorForKubernetesVersion(version string) (*Validator, error) {
+	resolved, err := ResolveKubernetesVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	embeddedValidatorsMu.Lock()
+	defer embeddedValidatorsMu.Unlock()
+
+	validator, ok := embeddedValidators[resolved]
+	if !ok {
+		validator = NewValidator(kubernetesJsonSchemaFS, resolved)
+		embeddedValidators[resolved] = validator
+	}
+	return validator, nil
+}
+
+// KubernetesVersions returns the Kubernetes versions of the embedded schemas, from the oldest to the newest
+func KubernetesVersions() []string {
+	return kubernetesVersions(kubernetesJsonSchemaFS)
+}
+
+// ResolveKubernetesVersion returns the embedded Kubernetes version with the same major and minor version as a version
+// such as 1.30, v1.30.2 or 1.30.x, and returns an error if there is none
+func ResolveKubernetesVersion(version string) (string, error) {
+	return resolveKubernetesVersion(KubernetesVersions(), version)
+}
+
+// NearestKubernetesVersion returns the embedded Kubernetes version whose minor version is the closest to a version,
+// preferring newer versions, or KUBERNETES_LINT_VERSION if the version cannot be parsed
+func NearestKubernetesVersion(version string) string {
+	return nearestKubernetesVersion(KubernetesVersions(), version)
+}
+
+// KubernetesVersion returns the Kubernetes version of the schemas of the Validator
+func (v *Validator) KubernetesVersion() string {
+	return v.kubernetesVersion
 }
 
-func initKubernetesJsonSchemaDir(schemaFS embed.FS) (string, error) {
-	tempDir, err := os.MkdirTemp("", "kubernetesjsonschema")
+// Schema returns the compiled schema of a kind, or ErrSchemaNotFound if there is none
+func (v *Validator) Schema(apiVersion string, kind string) (*gojsonschema.Schema, error) {
+	versionKind := apiVersion + "/" + kind
+
+	v.mu.Lock()
+	cached, ok := v.schemas[versionKind]
+	if !ok {
+		cached = &cachedSchema{}
+		v.schemas[versionKind] = cached
+	}
+	v.mu.Unlock()
+
+	cached.once.Do(func() {
+		cached.schema, cached.err = v.compileSchema(apiVersion, kind)
+	})
+
+	return cached.schema, cached.err
+}
+
+// Validate validates a YAML document against the schema of its apiVersion and kind. overrides are schemas by apiVersion/kind,
+// e.g. example.com/v1/Widget, that are used instead of the schemas of the Validator. Empty documents are valid.
+func (v *Validator) Validate(content []byte, overrides map[string]*gojsonschema.Schema) ([]gojsonschema.ResultError, error) {
+	var body map[string]interface{}
+	if err := yaml.Unmarshal(content, &body); err != nil {
+		return nil, errors.Wrap(err, "failed to decode yaml")
+	}
+	if body == nil {
+		return nil, nil
+	}
+
+	kind, err := getString(body, "kind")
+	if err != nil {
+		return nil, err
+	}
+	apiVersion, err := getString(body, "apiVersion")
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create temp dir")
+		return nil, err
 	}
 
-	err = fs.WalkDir(schemaFS, ".", func(path string, d fs.DirEntry, err error) error {
+	schema, ok := overrides[apiVersion+"/"+kind]
+	if !ok {
+		schema, err = v.Schema(apiVersion, kind)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := schema.Validate(gojsonschema.NewGoLoader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to validate against schema")
+	}
+
+	return result.Errors(), nil
+}
+
+func (v *Validator) compileSchema(apiVersion string, kind string) (*gojsonschema.Schema, error) {
+	v.indexOnce.Do(func() {
+		v.index, v.indexErr = indexSchemas(v.schemaFS, v.kubernetesVersion)
+	})
+	if v.indexErr != nil {
+		return nil, v.indexErr
+	}
+
+	schemaPath, ok := v.index[schemaFileName(apiVersion, kind)]
+	if !ok {
+		return nil, errors.Wrapf(ErrSchemaNotFound, "%s %s", apiVersion, kind)
+	}
+
+	data, err := fs.ReadFile(v.schemaFS, schemaPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", schemaPath)
+	}
+
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compile %s", schemaPath)
+	}
+
+	return schema, nil
+}
+
+// indexSchemas finds the schemas in the subdirectories of the root directory of schemaFS,
+// skipping the directories of Kubernetes versions other than kubernetesVersion
+func indexSchemas(schemaFS fs.FS, kubernetesVersion string) (map[string]string, error) {
+	index := map[string]string{}
+
+	err := fs.WalkDir(schemaFS, ".", func(filePath string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
 		if d.IsDir() {
+			if kubernetesSchemaDirRegex.MatchString(d.Name()) && d.Name() != kubernetesSchemaDir(kubernetesVersion) {
+				return fs.SkipDir
+			}
 			return nil
 		}
 
-		data, err := schemaFS.ReadFile(path)
+		parts := strings.Split(filePath, "/")
+		if len(parts) < 3 {
+			return nil
+		}
+		index[path.Join(parts[2:]...)] = filePath // trim root directory
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to walk kubernetes json schema dir")
+	}
+
+	return index, nil
+}
+
+// kubernetesVersions returns the Kubernetes versions of the schema directories in the subdirectories of the root directory of schemaFS
+func kubernetesVersions(schemaFS fs.FS) []string {
+	versions := []string{}
+
+	roots, err := fs.ReadDir(schemaFS, ".")
+	if err != nil {
+		return versions
+	}
+	for _, root := range roots {
+		if !root.IsDir() {
+			continue
+		}
+		dirs, err := fs.ReadDir(schemaFS, root.Name())
 		if err != nil {
-			return errors.Wrapf(err, "failed to read file %s", path)
+			continue
 		}
+		for _, dir := range dirs {
+			if dir.IsDir() && kubernetesSchemaDirRegex.MatchString(dir.Name()) {
+				versions = append(versions, strings.TrimSuffix(strings.TrimPrefix(dir.Name(), "v"), "-standalone-strict"))
+			}
+		}
+	}
 
-		parts := strings.Split(path, string(os.PathSeparator))
-		if len(parts) < 3 {
-			return nil
+	sort.Slice(versions, func(i, j int) bool {
+		return compareKubernetesVersions(versions[i], versions[j]) < 0
+	})
+
+	return versions
+}
+
+func resolveKubernetesVersion(versions []string, version string) (string, error) {
+	major, minor, ok := parseKubernetesVersion(version)
+	if ok {
+		// versions are sorted, prefer the newest patch version
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versionMajor, versionMinor, _ := parseKubernetesVersion(versions[i]); versionMajor == major && versionMinor == minor {
+				return versions[i], nil
+			}
 		}
-		destPath := filepath.Join(parts[2:]...) // trim root directory
-		destPath = filepath.Join(fmt.Sprintf("v%s-standalone-strict", KUBERNETES_LINT_VERSION), destPath)
+	}
+	return "", errors.Errorf("no schemas for kubernetes version %q, the available versions are %s", version, strings.Join(versions, ", "))
+}
+
+func nearestKubernetesVersion(versions []string, version string) string {
+	major, minor, ok := parseKubernetesVersion(version)
+	if !ok || len(versions) == 0 {
+		return KUBERNETES_LINT_VERSION
+	}
 
-		destDir := filepath.Dir(filepath.Join(tempDir, destPath))
-		if err := os.MkdirAll(destDir, 0755); err != nil {
-			return errors.Wrapf(err, "failed to create dir %s", destDir)
+	nearest, nearestDistance := "", -1
+	for _, candidate := range versions {
+		candidateMajor, candidateMinor, _ := parseKubernetesVersion(candidate)
+		distance := (candidateMajor-major)*1000 + candidateMinor - minor
+		if distance < 0 {
+			distance = -distance
 		}
+		// versions are sorted, so newer versions at the same distance replace older ones
+		if nearestDistance == -1 || distance <= nearestDistance {
+			nearest, nearestDistance = candidate, distance
+		}
+	}
+	return nearest
+}
 
-		if err := os.WriteFile(filepath.Join(tempDir, destPath), data, 0755); err != nil {
-			return errors.Wrap(err, "failed to write file")
+func kubernetesSchemaDir(kubernetesVersion string) string {
+	return fmt.Sprintf("v%s-standalone-strict", strings.TrimPrefix(kubernetesVersion, "v"))
+}
+
+// compareKubernetesVersions compares versions such as 1.33.3 by major, minor and patch version
+func compareKubernetesVersions(a string, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aPart, _ := strconv.Atoi(aParts[i])
+		bPart, _ := strconv.Atoi(bParts[i])
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
 		}
+	}
+	return len(aParts) - len(bParts)
+}
 
-		return nil
-	})
-	if err != nil {
-		return "", errors.Wrap(err, "failed to walk kubernetes json schema dir")
+func parseKubernetesVersion(version string) (int, int, bool) {
+	matches := kubernetesVersionRegex.FindStringSubmatch(version)
+	if matches == nil {
+		return 0, 0, false
+	}
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	return major, minor, true
+}
+
+// schemaFileName returns the file name of the schema of a kind the way kubeval names them,
+// e.g. deployment-apps-v1.json for apps/v1 Deployment and configmap-v1.json for v1 ConfigMap
+func schemaFileName(apiVersion string, kind string) string {
+	groupParts := strings.Split(apiVersion, "/")
+	versionParts := strings.Split(groupParts[0], ".")
+
+	kindSuffix := "-" + strings.ToLower(versionParts[0])
+	if len(groupParts) > 1 {
+		kindSuffix += "-" + strings.ToLower(groupParts[1])
 	}
 
-	KubernetesJsonSchemaDir = tempDir
+	return fmt.Sprintf("%s%s.json", strings.ToLower(kind), kindSuffix)
+}
+
+func getString(body map[string]interface{}, key string) (string, error) {
+	value, found := body[key]
+	if !found {
+		return "", errors.Errorf("Missing '%s' key", key)
+	}
+	if value == nil {
+		return "", errors.Errorf("Missing '%s' value", key)
+	}
+	typedValue, ok := value.(string)
+	if !ok {
+		return "", errors.Errorf("Expected string value for key '%s'", key)
+	}
+	return typedValue, nil
+}
+
+// anyFormat accepts every value of a format
+type anyFormat struct{}
 
-	return tempDir, nil
+func (f anyFormat) IsFormat(input interface{}) bool {
+	return true
 }